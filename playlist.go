@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsSegmentSeconds is the fixed segment duration used when synthesizing
+// a VOD playlist. Real HLS packagers vary this per-segment to land on
+// keyframes; since segments here are produced with "-c copy" (no
+// re-encode), a fixed duration keeps the math simple at the cost of
+// segment boundaries that may drift a little from keyframes.
+const hlsSegmentSeconds = 4
+
+// segmentPathPattern matches "<name>/seg-<index>.ts" requests, where name
+// may itself contain slashes (subdirectories).
+var segmentPathPattern = regexp.MustCompile(`^(.+)/seg-(\d+)\.ts$`)
+
+// handleHLSRequest serves /<name>.m3u8 and /<name>/seg-N.ts, the HLS
+// on-the-fly segmentation routes layered over the raw-file routes. It
+// reports whether urlPath matched one of those routes (and so was
+// handled) so the caller can fall through to its own routing otherwise.
+func (vs *VideoServer) handleHLSRequest(w http.ResponseWriter, r *http.Request, urlPath string) bool {
+	if name, ok := strings.CutSuffix(urlPath, ".m3u8"); ok {
+		vs.handlePlaylist(w, r, name)
+		return true
+	}
+	if m := segmentPathPattern.FindStringSubmatch(urlPath); m != nil {
+		index, err := strconv.Atoi(m[2])
+		if err != nil {
+			http.Error(w, "Invalid segment index", http.StatusBadRequest)
+			return true
+		}
+		vs.handleSegment(w, r, m[1], index)
+		return true
+	}
+	return false
+}
+
+// handlePlaylist probes the named source video with ffprobe and writes a
+// fixed-duration VOD playlist pointing at this server's own segment URLs.
+func (vs *VideoServer) handlePlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	_, sourcePath, ok := vs.hlsSourcePath(w, name)
+	if !ok {
+		return
+	}
+
+	duration, err := vs.probeDuration(sourcePath)
+	if err != nil {
+		http.Error(w, "Error probing video", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprint(w, buildPlaylist(name, duration))
+}
+
+// handleSegment serves a single transcoded segment, producing and caching
+// it via ffmpeg on first request for that (source path, mtime, index)
+// tuple.
+func (vs *VideoServer) handleSegment(w http.ResponseWriter, r *http.Request, name string, index int) {
+	relPath, sourcePath, ok := vs.hlsSourcePath(w, name)
+	if !ok {
+		return
+	}
+
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	segPath, err := vs.cachedSegment(relPath, sourcePath, info.ModTime(), index)
+	if err != nil {
+		http.Error(w, "Error producing segment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, segPath)
+}
+
+// hlsSourcePath resolves name to a file in vs.fsys matching one of
+// videoExtensions, returning both its path relative to vs.fsys (used to
+// key the segment cache) and its real on-disk path (used to invoke
+// ffmpeg/ffprobe). It writes an error response and returns ok=false if
+// ffmpeg isn't available, the source isn't disk-backed, or no matching
+// file exists.
+func (vs *VideoServer) hlsSourcePath(w http.ResponseWriter, name string) (relPath, sourcePath string, ok bool) {
+	if _, err := exec.LookPath(vs.ffmpegBinary()); err != nil {
+		http.Error(w, "HLS segmentation requires ffmpeg on PATH", http.StatusNotImplemented)
+		return "", "", false
+	}
+	if vs.root == "" {
+		http.Error(w, "HLS segmentation requires a disk-backed video source", http.StatusNotImplemented)
+		return "", "", false
+	}
+
+	relPath, err := vs.resolveSourceFile(name)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return "", "", false
+	}
+	return relPath, filepath.Join(vs.root, relPath), true
+}
+
+// sortedVideoExtensions lists videoExtensions in a fixed order, so that
+// resolveSourceFile checks candidates deterministically rather than in
+// Go's randomized map iteration order.
+var sortedVideoExtensions = func() []string {
+	exts := make([]string, 0, len(videoExtensions))
+	for ext := range videoExtensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}()
+
+// resolveSourceFile finds the file backing an HLS name (a path with no
+// extension) by checking each known video extension in a fixed order, so
+// that if a directory has both e.g. movie.mp4 and movie.mkv, the same
+// one consistently backs /movie.m3u8 and /movie/seg-N.ts rather than it
+// depending on map iteration order.
+func (vs *VideoServer) resolveSourceFile(name string) (string, error) {
+	for _, ext := range sortedVideoExtensions {
+		candidate := name + ext
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+		if _, err := fs.Stat(vs.fsys, candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fs.ErrNotExist
+}
+
+// probeDuration shells out to ffprobe to get sourcePath's duration.
+func (vs *VideoServer) probeDuration(sourcePath string) (time.Duration, error) {
+	out, err := exec.Command(vs.ffprobeBinary(),
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		sourcePath,
+	).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// buildPlaylist synthesizes a VOD #EXTM3U playlist of fixed-duration
+// segments covering duration, pointing at "<name>/seg-N.ts".
+func buildPlaylist(name string, duration time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n", hlsSegmentSeconds)
+
+	remaining := duration.Seconds()
+	for i := 0; remaining > 0; i++ {
+		segDur := float64(hlsSegmentSeconds)
+		if remaining < segDur {
+			segDur = remaining
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s/seg-%d.ts\n", segDur, name, i)
+		remaining -= segDur
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// cachedSegment returns the path to the cached mpegts segment at index
+// for relPath (sourcePath's path relative to vs.fsys), producing it with
+// ffmpeg first if it isn't already cached for this exact (relPath,
+// modTime, index) tuple. relPath, rather than sourcePath's basename, is
+// hashed into the cache key so that two videos with the same filename in
+// different subdirectories don't collide on the same cache entry.
+//
+// Concurrent requests for the same uncached segment (typical of HLS
+// players prefetching ahead) are serialized with segmentLocks so only
+// one ffmpeg invocation produces it; ffmpeg writes to a temp file that is
+// renamed into place atomically, so a concurrent reader via
+// http.ServeFile never observes a partially-written segment.
+func (vs *VideoServer) cachedSegment(relPath, sourcePath string, modTime time.Time, index int) (string, error) {
+	cacheDir := vs.cacheDir()
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	key := segmentCacheKey(relPath, modTime, index)
+	cachePath := filepath.Join(cacheDir, key)
+
+	unlock := vs.lockSegment(cachePath)
+	defer unlock()
+
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	tmp, err := os.CreateTemp(cacheDir, key+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	cmd := exec.Command(vs.ffmpegBinary(),
+		"-ss", strconv.Itoa(index*hlsSegmentSeconds),
+		"-t", strconv.Itoa(hlsSegmentSeconds),
+		"-i", sourcePath,
+		"-c", "copy",
+		"-f", "mpegts",
+		"-y",
+		tmpPath,
+	)
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// segmentCacheKey derives the cache filename for segment index of the
+// source file at relPath (vs.fsys-relative) last modified at modTime.
+// relPath is hashed rather than just taking its basename so that two
+// videos with the same filename in different subdirectories (plausible
+// after a bulk copy that preserves mtimes) don't collide on the same
+// cache entry.
+func segmentCacheKey(relPath string, modTime time.Time, index int) string {
+	sum := sha256.Sum256([]byte(relPath))
+	return fmt.Sprintf("%x-%d-seg-%d.ts", sum, modTime.UnixNano(), index)
+}
+
+// segmentLocks holds a *sync.Mutex per in-flight cache key, so concurrent
+// requests for the same segment wait for the first to finish producing
+// it instead of racing duplicate ffmpeg invocations. Entries are removed
+// once the holder is done (see lockSegment) so this only ever holds one
+// entry per segment currently being produced, not one per segment ever
+// requested - otherwise a long-lived server serving a large, rotating
+// library would leak a mutex per distinct segment for its entire
+// lifetime.
+var segmentLocks sync.Map
+
+// lockSegment locks the mutex for cachePath and returns a func to unlock
+// it and drop it from segmentLocks. Dropping it is safe even if another
+// goroutine is concurrently waiting on the same (now unmapped) mutex: it
+// already holds the pointer from its own Load, so it still unblocks
+// normally; any later caller just gets a fresh mutex, which is harmless
+// since by then the segment is either cached on disk or failed.
+func (vs *VideoServer) lockSegment(cachePath string) func() {
+	v, _ := segmentLocks.LoadOrStore(cachePath, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return func() {
+		segmentLocks.Delete(cachePath)
+		mu.Unlock()
+	}
+}
+
+func (vs *VideoServer) cacheDir() string {
+	if vs.CacheDir != "" {
+		return vs.CacheDir
+	}
+	return filepath.Join(os.TempDir(), "vs-hls-cache")
+}
+
+func (vs *VideoServer) ffmpegBinary() string {
+	if vs.FFmpegPath != "" {
+		return vs.FFmpegPath
+	}
+	return "ffmpeg"
+}
+
+func (vs *VideoServer) ffprobeBinary() string {
+	if vs.FFprobePath != "" {
+		return vs.FFprobePath
+	}
+	return "ffprobe"
+}
@@ -1,202 +1,462 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type VideoServer struct {
-	port     string
-	videoDir string
+	port string
+	fsys fs.FS
+	root string // human-readable source for the startup banner; also lets HLS shell out to ffmpeg by real path. Empty for non-path backends.
+
+	// FFmpegPath and FFprobePath override the ffmpeg/ffprobe binaries used
+	// for on-the-fly HLS segmentation (see playlist.go). Left empty, they
+	// default to "ffmpeg"/"ffprobe" resolved from $PATH.
+	FFmpegPath  string
+	FFprobePath string
+
+	// CacheDir holds completed HLS segments, keyed by source mtime and
+	// segment index, so repeat seeks don't re-invoke ffmpeg. Defaults to
+	// a "vs-hls-cache" directory under os.TempDir().
+	CacheDir string
+}
+
+// videoExtensions is the set of file extensions listFiles and the HLS
+// playlist/segment handlers treat as servable videos.
+var videoExtensions = map[string]bool{
+	".mkv":  true,
+	".mp4":  true,
+	".avi":  true,
+	".mov":  true,
+	".wmv":  true,
+	".flv":  true,
+	".webm": true,
 }
 
+// NewVideoServer builds a server that serves videoDir directly off disk.
 func NewVideoServer(port, videoDir string) *VideoServer {
 	return &VideoServer{
-		port:     port,
-		videoDir: videoDir,
+		port: port,
+		fsys: os.DirFS(videoDir),
+		root: videoDir,
+	}
+}
+
+// NewVideoServerFS builds a server backed by an arbitrary fs.FS, e.g. an
+// embed.FS, a tar/zip archive opened with a fs.FS adapter, or a remote
+// object store fronted by one.
+func NewVideoServerFS(port string, fsys fs.FS) *VideoServer {
+	return &VideoServer{
+		port: port,
+		fsys: fsys,
 	}
 }
 
 func (vs *VideoServer) Start() {
 	http.HandleFunc("/", vs.handleRequest)
-	
+
 	fmt.Printf("Starting video streaming server on port %s\n", vs.port)
-	fmt.Printf("Serving files from: %s\n", vs.videoDir)
+	if vs.root != "" {
+		fmt.Printf("Serving files from: %s\n", vs.root)
+	}
 	fmt.Printf("Access videos at: http://0.0.0.0:%s/filename.mkv\n", vs.port)
-	
+
 	log.Fatal(http.ListenAndServe(":"+vs.port, nil))
 }
 
 func (vs *VideoServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	// Get file path from URL
 	filePath := strings.TrimPrefix(r.URL.Path, "/")
-	fullPath := filepath.Join(vs.videoDir, filePath)
-	
-	// Security check - prevent directory traversal
-	absVideoDir, _ := filepath.Abs(vs.videoDir)
-	absFullPath, _ := filepath.Abs(fullPath)
-	if !strings.HasPrefix(absFullPath, absVideoDir) {
+	if filePath == "" {
+		filePath = "."
+	}
+
+	// Security check - reject path traversal before it reaches the fs.FS
+	if !fs.ValidPath(filePath) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
-	
+
+	// HLS playlist/segment requests are layered on top of the raw-file
+	// routes below rather than replacing them; see playlist.go.
+	if vs.handleHLSRequest(w, r, filePath) {
+		return
+	}
+
 	// Check if file exists
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) || fileInfo.IsDir() {
-		if r.URL.Path == "/" {
+	fileInfo, err := fs.Stat(vs.fsys, filePath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fileInfo.IsDir()) {
+		if filePath == "." {
 			vs.listFiles(w, r)
 			return
 		}
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
-	
+	if err != nil {
+		http.Error(w, "Error accessing file", http.StatusInternalServerError)
+		return
+	}
+
 	// Get file info
 	fileSize := fileInfo.Size()
-	mimeType := mime.TypeByExtension(filepath.Ext(fullPath))
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	modTime := fileInfo.ModTime()
+	etag := fmt.Sprintf(`"%d-%d"`, fileSize, modTime.UnixNano())
+	mimeType := mime.TypeByExtension(path.Ext(filePath))
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		if sniffed, ok := sniffContentType(vs.fsys, filePath); ok {
+			mimeType = sniffed
+		} else if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
 	}
-	
+
 	// Set basic headers
 	w.Header().Set("Content-Type", mimeType)
 	w.Header().Set("Accept-Ranges", "bytes")
-	
-	// Handle range requests for seeking support
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag)
+
+	// Honor If-None-Match / If-Modified-Since: if the client's cached
+	// copy is still fresh, skip re-sending the body entirely.
+	if isNotModified(r, etag, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Handle range requests for seeking support. If-Range lets a client
+	// fall back to a full 200 response when its cached representation
+	// (and therefore the byte offsets it computed) is stale.
 	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" && !ifRangeMatches(r, etag, modTime) {
+		rangeHeader = ""
+	}
 	if rangeHeader != "" {
-		vs.handleRangeRequest(w, r, fullPath, fileSize, rangeHeader)
+		vs.handleRangeRequest(w, r, filePath, fileSize, mimeType, rangeHeader)
 	} else {
 		// Serve entire file
 		w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
-		
-		file, err := os.Open(fullPath)
+
+		file, err := vs.fsys.Open(filePath)
 		if err != nil {
 			http.Error(w, "Error opening file", http.StatusInternalServerError)
 			return
 		}
 		defer file.Close()
-		
+
 		io.Copy(w, file)
 	}
 }
 
-func (vs *VideoServer) handleRangeRequest(w http.ResponseWriter, r *http.Request, filePath string, fileSize int64, rangeHeader string) {
-	// Parse range header (e.g., "bytes=0-1023")
-	re := regexp.MustCompile(`bytes=(\d+)-(\d*)`)
-	matches := re.FindStringSubmatch(rangeHeader)
-	
-	if len(matches) < 3 {
-		http.Error(w, "Invalid range header", http.StatusBadRequest)
-		return
+// sniffContentType opens filePath on fsys and runs http.DetectContentType
+// over its leading bytes, the same fallback http.ServeContent uses when a
+// file's extension isn't in the mime database (e.g. ".mkv" on many Linux
+// systems). The file is opened and read independently of the handlers
+// that actually serve it, so no bytes are consumed from those.
+func sniffContentType(fsys fs.FS, filePath string) (string, bool) {
+	file, err := fsys.Open(filePath)
+	if err != nil {
+		return "", false
 	}
-	
-	startByte, err := strconv.ParseInt(matches[1], 10, 64)
+	defer file.Close()
+
+	// Read, unlike ReadFull, is allowed to return short reads; on a
+	// backend where that's common (an archive or remote-object-store
+	// fs.FS, for instance) a plain Read could hand DetectContentType a
+	// sliver of the file and misdetect it. http.ServeContent guards
+	// against this with io.ReadFull, so we do too.
+	var buf [512]byte
+	n, err := io.ReadFull(file, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", false
+	}
+	return http.DetectContentType(buf[:n]), true
+}
+
+// isNotModified reports whether, per If-None-Match (preferred) or
+// If-Modified-Since, the client already holds the current representation
+// of the file identified by etag/modTime.
+func isNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether etag appears in a comma-separated
+// If-None-Match/If-Match header, honoring the "*" wildcard.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches reports whether a Range request should still be served
+// as partial content. With no If-Range header, ranges are always honored.
+// Otherwise the client's validator (an ETag or a date) must match the
+// file's current one, or we fall back to serving the whole file.
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		return ir == etag
+	}
+	t, err := http.ParseTime(ir)
 	if err != nil {
-		http.Error(w, "Invalid range start", http.StatusBadRequest)
-		return
+		return false
 	}
-	
-	var endByte int64
-	if matches[2] == "" {
-		endByte = fileSize - 1
-	} else {
-		endByte, err = strconv.ParseInt(matches[2], 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid range end", http.StatusBadRequest)
-			return
+	return modTime.Truncate(time.Second).Equal(t)
+}
+
+// byteRange is an inclusive [start, end] span of file bytes, as produced by
+// parseRanges.
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+// errMalformedRange is returned by parseRanges when the header doesn't
+// follow the "bytes=range-spec[,range-spec...]" syntax at all, as opposed
+// to being syntactically valid but unsatisfiable against fileSize.
+var errMalformedRange = fmt.Errorf("malformed range header")
+
+// errUnsatisfiableRange is returned by parseRanges when every range-spec
+// in an otherwise well-formed header falls outside fileSize.
+var errUnsatisfiableRange = fmt.Errorf("unsatisfiable range")
+
+// parseRanges parses a "Range: bytes=..." header into the list of byte
+// ranges it requests, per RFC 7233 Section 2.1. It accepts a
+// comma-separated list of range-specs (e.g. "bytes=0-1,5-8") and suffix
+// ranges ("bytes=-500" meaning the last 500 bytes). Ranges are not
+// required to be sorted or non-overlapping. Specs that start at or past
+// fileSize are dropped as unsatisfiable; if every spec is dropped, it
+// returns errUnsatisfiableRange.
+func parseRanges(rangeHeader string, fileSize int64) (ranges []byteRange, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return nil, errMalformedRange
+	}
+
+	for _, spec := range strings.Split(rangeHeader[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, errMalformedRange
 		}
+		startPart, endPart := spec[:dash], spec[dash+1:]
+
+		var br byteRange
+		if startPart == "" {
+			// Suffix range: the last N bytes of the file, i.e.
+			// start = max(0, fileSize-N). "bytes=-0" is a well-formed
+			// but unsatisfiable zero-length suffix, not a parse error.
+			n, err := strconv.ParseInt(endPart, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errMalformedRange
+			}
+			if n > fileSize {
+				n = fileSize
+			}
+			if n == 0 {
+				// Either an explicit "bytes=-0" or, against a
+				// zero-length file, any suffix length clamps to 0:
+				// a zero-length suffix is unsatisfiable either way.
+				continue
+			}
+			br.start = fileSize - n
+			br.end = fileSize - 1
+		} else {
+			start, err := strconv.ParseInt(startPart, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errMalformedRange
+			}
+			if start >= fileSize {
+				continue
+			}
+			br.start = start
+			if endPart == "" {
+				br.end = fileSize - 1
+			} else {
+				end, err := strconv.ParseInt(endPart, 10, 64)
+				if err != nil {
+					return nil, errMalformedRange
+				}
+				if end < start {
+					continue
+				}
+				if end >= fileSize {
+					end = fileSize - 1
+				}
+				br.end = end
+			}
+		}
+		ranges = append(ranges, br)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
 	}
-	
-	// Validate range
-	if startByte >= fileSize || endByte >= fileSize || startByte > endByte {
+	return ranges, nil
+}
+
+func (vs *VideoServer) handleRangeRequest(w http.ResponseWriter, r *http.Request, filePath string, fileSize int64, mimeType, rangeHeader string) {
+	ranges, err := parseRanges(rangeHeader, fileSize)
+	if err == errMalformedRange {
+		http.Error(w, "Invalid range header", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
 		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
 		http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
-	
-	contentLength := endByte - startByte + 1
-	
-	// Set partial content headers
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", startByte, endByte, fileSize))
-	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	w.WriteHeader(http.StatusPartialContent)
-	
-	// Stream the requested range
-	file, err := os.Open(filePath)
+
+	file, err := vs.fsys.Open(filePath)
 	if err != nil {
 		http.Error(w, "Error opening file", http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
-	
-	// Seek to start position
-	file.Seek(startByte, 0)
-	
-	// Stream in chunks to avoid loading large amounts into memory
-	chunkSize := int64(1024 * 1024) // 1MB chunks
-	remaining := contentLength
-	
-	for remaining > 0 {
-		toRead := chunkSize
-		if remaining < chunkSize {
-			toRead = remaining
+
+	rs, ok := file.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "Range requests not supported for this file", http.StatusInternalServerError)
+		return
+	}
+
+	if len(ranges) == 1 {
+		vs.serveSingleRange(w, rs, ranges[0], fileSize)
+		return
+	}
+	vs.serveMultipartRanges(w, rs, ranges, mimeType, fileSize)
+}
+
+// writeRangeBody seeks rs to br.start and copies br.length() bytes to w.
+func writeRangeBody(w io.Writer, rs io.ReadSeeker, br byteRange) error {
+	if _, err := rs.Seek(br.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, rs, br.length())
+	return err
+}
+
+func (vs *VideoServer) serveSingleRange(w http.ResponseWriter, rs io.ReadSeeker, br byteRange, fileSize int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, fileSize))
+	w.Header().Set("Content-Length", strconv.FormatInt(br.length(), 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if err := writeRangeBody(w, rs, br); err != nil && err != io.EOF {
+		log.Printf("Error streaming file: %v", err)
+	}
+}
+
+// countingWriter discards everything written to it while tallying the
+// number of bytes, so the exact size of a multipart/byteranges response
+// can be computed up front for Content-Length.
+type countingWriter int64
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	*cw += countingWriter(len(p))
+	return len(p), nil
+}
+
+func rangePartHeader(mimeType string, br byteRange, fileSize int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {mimeType},
+		"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, fileSize)},
+	}
+}
+
+func multipartContentLength(ranges []byteRange, mimeType string, fileSize int64, boundary string) int64 {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	mw.SetBoundary(boundary)
+	var total int64
+	for _, br := range ranges {
+		mw.CreatePart(rangePartHeader(mimeType, br, fileSize))
+		total += br.length()
+	}
+	mw.Close()
+	return total + int64(cw)
+}
+
+func (vs *VideoServer) serveMultipartRanges(w http.ResponseWriter, rs io.ReadSeeker, ranges []byteRange, mimeType string, fileSize int64) {
+	mw := multipart.NewWriter(w)
+	defer mw.Close()
+
+	w.Header().Set("Content-Type", fmt.Sprintf("multipart/byteranges; boundary=%s", mw.Boundary()))
+	w.Header().Set("Content-Length", strconv.FormatInt(multipartContentLength(ranges, mimeType, fileSize, mw.Boundary()), 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	for _, br := range ranges {
+		part, err := mw.CreatePart(rangePartHeader(mimeType, br, fileSize))
+		if err != nil {
+			log.Printf("Error creating multipart part: %v", err)
+			return
 		}
-		
-		written, err := io.CopyN(w, file, toRead)
-		if err != nil && err != io.EOF {
+		if err := writeRangeBody(part, rs, br); err != nil && err != io.EOF {
 			log.Printf("Error streaming file: %v", err)
 			return
 		}
-		
-		remaining -= written
-		if written == 0 {
-			break
-		}
 	}
 }
 
 func (vs *VideoServer) listFiles(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
-	
-	// Get video files
-	videoExtensions := map[string]bool{
-		".mkv":  true,
-		".mp4":  true,
-		".avi":  true,
-		".mov":  true,
-		".wmv":  true,
-		".flv":  true,
-		".webm": true,
-	}
-	
+
 	var files []FileInfo
-	filepath.Walk(vs.videoDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+	fs.WalkDir(vs.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
 			return nil
 		}
-		
-		ext := strings.ToLower(filepath.Ext(path))
+
+		ext := strings.ToLower(path.Ext(p))
 		if videoExtensions[ext] {
-			relPath, _ := filepath.Rel(vs.videoDir, path)
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
 			files = append(files, FileInfo{
-				Name:     relPath,
-				SizeMB:   float64(info.Size()) / 1024.0 / 1024.0,
-				FullPath: path,
+				Name:   p,
+				SizeMB: float64(info.Size()) / 1024.0 / 1024.0,
 			})
 		}
 		return nil
 	})
-	
+
 	tmpl := `<!DOCTYPE html>
 <html>
 <head>
@@ -231,21 +491,20 @@ func (vs *VideoServer) listFiles(w http.ResponseWriter, r *http.Request) {
     </p>
 </body>
 </html>`
-	
+
 	t := template.Must(template.New("files").Parse(tmpl))
 	t.Execute(w, files)
 }
 
 type FileInfo struct {
-	Name     string
-	SizeMB   float64
-	FullPath string
+	Name   string
+	SizeMB float64
 }
 
 func main() {
 	videoDir := "."
 	port := "32767"
-	
+
 	// Parse command line arguments
 	if len(os.Args) > 1 {
 		videoDir = os.Args[1]
@@ -253,18 +512,18 @@ func main() {
 	if len(os.Args) > 2 {
 		port = os.Args[2]
 	}
-	
+
 	// Expand relative paths
 	absVideoDir, err := filepath.Abs(videoDir)
 	if err != nil {
 		log.Fatalf("Error resolving video directory: %v", err)
 	}
-	
+
 	// Check if video directory exists
 	if _, err := os.Stat(absVideoDir); os.IsNotExist(err) {
 		log.Fatalf("Video directory does not exist: %s", absVideoDir)
 	}
-	
+
 	server := NewVideoServer(port, absVideoDir)
 	server.Start()
 }